@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// idempotencyHeader は冪等性キーを受け渡すHTTPヘッダー名です
+const idempotencyHeader = "Idempotency-Key"
+
+// idempotencyReplayedHeader はレスポンスがキャッシュからの再生であることを示すヘッダー名です
+const idempotencyReplayedHeader = "Idempotent-Replayed"
+
+// idempotencyRecord はidempotency_keysテーブルの1レコードを表す構造体です
+type idempotencyRecord struct {
+	IdempotencyKey string         `db:"idempotency_key"`
+	Fingerprint    string         `db:"fingerprint"`
+	StatusCode     sql.NullInt64  `db:"status_code"`
+	ResponseBody   sql.NullString `db:"response_body"`
+}
+
+// responseRecorder はハンドラーが書き込んだレスポンスをクライアントへ転送しつつ記録します
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// IdempotencyMiddleware はIdempotency-Keyヘッダーによるレスポンスのキャッシュ再生を行うミドルウェアです
+// キーを指定した最初のリクエストは、自身が開始したDBトランザクションをリクエストコンテキスト経由で
+// ハンドラーへ共有します。ハンドラー(processTransaction/processPostings)はexecInTxを通じてこの
+// 共有トランザクションを再利用するため、残高更新とidempotencyレコードの確定は単一のコミットで
+// アトミックに行われます。ハンドラーが失敗した場合はsharedTx.failedが立ち、idempotencyレコードを
+// 確定させないままロールバックするため、再試行時は何も無かったものとしてやり直せます。
+// 同じキーを持つ後続のリクエストは、その行の排他ロックが解放されるまで待たされた上で、
+// 指紋(リクエストボディのハッシュ)が一致すれば確定済みのレスポンスをそのまま再生します。
+func IdempotencyMiddleware(db *sqlx.DB) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(idempotencyHeader)
+			if key == "" {
+				return next(c)
+			}
+
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "リクエストが不正です"})
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+			fingerprint := fmt.Sprintf("%x", sha256.Sum256(body))
+
+			tx, err := db.Beginx()
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to begin idempotency check"})
+			}
+			committed := false
+			defer func() {
+				if !committed {
+					tx.Rollback()
+				}
+			}()
+
+			var existing idempotencyRecord
+			err = tx.Get(&existing, `
+        SELECT * FROM idempotency_keys WHERE idempotency_key = $1 FOR UPDATE
+      `, key)
+
+			if err == sql.ErrNoRows {
+				// 初回のリクエストです。in-flightマーカーを挿入し、ハンドラー実行中も行ロックを保持します
+				if _, err := tx.Exec(`
+          INSERT INTO idempotency_keys (idempotency_key, fingerprint, status_code, response_body)
+          VALUES ($1, $2, NULL, NULL)
+        `, key, fingerprint); err != nil {
+					// 同じキーで並行に挿入しようとした別リクエストと競合した場合、
+					// 先行リクエストがコミットされるのを待ってからその結果を再生します
+					tx.Rollback()
+					committed = true
+					return replayIdempotentResponse(db, c, key, fingerprint)
+				}
+
+				// このトランザクションをハンドラーと共有し、業務ロジックとidempotencyレコードの
+				// 確定を同一コミットにまとめます
+				shared := &sharedTx{tx: tx}
+				c.SetRequest(c.Request().WithContext(contextWithTx(c.Request().Context(), shared)))
+
+				rec := &responseRecorder{ResponseWriter: c.Response().Writer, status: http.StatusOK}
+				c.Response().Writer = rec
+
+				handlerErr := next(c)
+
+				if shared.failed {
+					// 業務ロジックが失敗しました。in-flightマーカーごとロールバックし、
+					// 次回の同じキーでのリクエストが一から再試行できるようにします
+					return handlerErr
+				}
+
+				if _, err := tx.Exec(`
+          UPDATE idempotency_keys SET status_code = $1, response_body = $2
+          WHERE idempotency_key = $3
+        `, rec.status, rec.body.String(), key); err != nil {
+					return err
+				}
+
+				if err := tx.Commit(); err != nil {
+					return err
+				}
+				committed = true
+
+				return handlerErr
+			}
+
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check idempotency key"})
+			}
+
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			committed = true
+
+			return writeReplayedResponse(c, existing, fingerprint)
+		}
+	}
+}
+
+// replayIdempotentResponse は、確定済み(コミット済み)のレスポンスを待ってから再生します
+// in-flightマーカーの挿入が一意制約違反になった場合、すなわち同じキーのリクエストが
+// 既に処理中または処理済みの場合にのみ呼び出されます
+func replayIdempotentResponse(db *sqlx.DB, c echo.Context, key, fingerprint string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to begin idempotency check"})
+	}
+	defer tx.Rollback()
+
+	var existing idempotencyRecord
+	if err := tx.Get(&existing, `
+    SELECT * FROM idempotency_keys WHERE idempotency_key = $1 FOR UPDATE
+  `, key); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check idempotency key"})
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return writeReplayedResponse(c, existing, fingerprint)
+}
+
+// writeReplayedResponse は確定済みのidempotencyレコードをレスポンスとして書き出します
+func writeReplayedResponse(c echo.Context, existing idempotencyRecord, fingerprint string) error {
+	if existing.Fingerprint != fingerprint {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Idempotency-Key already used with a different request body"})
+	}
+
+	c.Response().Header().Set(idempotencyReplayedHeader, "true")
+	c.Response().WriteHeader(int(existing.StatusCode.Int64))
+	var raw json.RawMessage
+	if existing.ResponseBody.Valid {
+		raw = json.RawMessage(existing.ResponseBody.String)
+	}
+	_, err := c.Response().Write(raw)
+	return err
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyMiddleware_ReplaysResponse(t *testing.T) {
+	db := SetupTestDB()
+	defer db.Close()
+
+	e := echo.New()
+	e.Validator = &CustomValidator{validator: validator.New()}
+	handler := handlerWithIdempotency(db)
+
+	body := `{
+		"sender_id": "user1",
+		"receiver_id": "user2",
+		"amount": 100,
+		"transaction_id": "tx_idempotent",
+		"effective_date": "2999-01-01T10:00:00Z"
+	}`
+
+	req1 := httptest.NewRequest(http.MethodPost, "/transaction", strings.NewReader(body))
+	req1.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req1.Header.Set(idempotencyHeader, "key-1")
+	rec1 := httptest.NewRecorder()
+	assert.NoError(t, handler(e.NewContext(req1, rec1)))
+	assert.Equal(t, http.StatusOK, rec1.Code)
+	assert.Empty(t, rec1.Header().Get(idempotencyReplayedHeader))
+
+	// 同じキー・同じボディでの再実行は、取引を再実行せずに保存済みレスポンスを返します
+	req2 := httptest.NewRequest(http.MethodPost, "/transaction", strings.NewReader(body))
+	req2.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req2.Header.Set(idempotencyHeader, "key-1")
+	rec2 := httptest.NewRecorder()
+	assert.NoError(t, handler(e.NewContext(req2, rec2)))
+	assert.Equal(t, http.StatusOK, rec2.Code)
+	assert.Equal(t, "true", rec2.Header().Get(idempotencyReplayedHeader))
+	assert.Equal(t, rec1.Body.String(), rec2.Body.String())
+
+	// 同じキーでボディが異なる場合は422を返します
+	mismatched := strings.Replace(body, "tx_idempotent", "tx_idempotent_mismatch", 1)
+	req3 := httptest.NewRequest(http.MethodPost, "/transaction", strings.NewReader(mismatched))
+	req3.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req3.Header.Set(idempotencyHeader, "key-1")
+	rec3 := httptest.NewRecorder()
+	assert.NoError(t, handler(e.NewContext(req3, rec3)))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec3.Code)
+}
+
+func TestIdempotencyMiddleware_RollsBackOnHandlerFailure(t *testing.T) {
+	db := SetupTestDB()
+	defer db.Close()
+
+	e := echo.New()
+	e.Validator = &CustomValidator{validator: validator.New()}
+	handler := handlerWithIdempotency(db)
+
+	body := `{
+		"sender_id": "nonexistent",
+		"receiver_id": "user2",
+		"amount": 100,
+		"transaction_id": "tx_idempotent_fail",
+		"effective_date": "2999-01-01T10:00:00Z"
+	}`
+
+	req1 := httptest.NewRequest(http.MethodPost, "/transaction", strings.NewReader(body))
+	req1.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req1.Header.Set(idempotencyHeader, "key-fail")
+	rec1 := httptest.NewRecorder()
+	assert.NoError(t, handler(e.NewContext(req1, rec1)))
+	assert.Equal(t, http.StatusInternalServerError, rec1.Code)
+
+	// 業務ロジックが失敗した場合、idempotencyレコードは残高更新と同じトランザクションで
+	// ロールバックされるため、in-flightマーカーも残りません
+	var count int
+	assert.NoError(t, db.Get(&count, `SELECT COUNT(*) FROM idempotency_keys WHERE idempotency_key = $1`, "key-fail"))
+	assert.Equal(t, 0, count)
+
+	// 同じキーで再試行すると、キャッシュされた結果ではなく業務ロジックが改めて実行されます
+	req2 := httptest.NewRequest(http.MethodPost, "/transaction", strings.NewReader(body))
+	req2.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req2.Header.Set(idempotencyHeader, "key-fail")
+	rec2 := httptest.NewRecorder()
+	assert.NoError(t, handler(e.NewContext(req2, rec2)))
+	assert.Equal(t, http.StatusInternalServerError, rec2.Code)
+	assert.Empty(t, rec2.Header().Get(idempotencyReplayedHeader))
+}
+
+func TestIdempotencyMiddleware_ConcurrentRequestsShareOneResult(t *testing.T) {
+	// 同じIdempotency-Keyを持つ2つのリクエストが本当に並行して届いた場合、後続のリクエストは
+	// in-flightマーカー行の排他ロックが解放される(先行リクエストがコミットする)まで
+	// replayIdempotentResponse内でブロックされ、その後に確定済みのレスポンスを再生するはずです
+	db := SetupTestDB()
+	defer db.Close()
+
+	e := echo.New()
+	e.Validator = &CustomValidator{validator: validator.New()}
+	handler := handlerWithIdempotency(db)
+
+	body := `{
+		"sender_id": "user1",
+		"receiver_id": "user2",
+		"amount": 100,
+		"transaction_id": "tx_idempotent_concurrent",
+		"effective_date": "2999-01-01T10:00:00Z"
+	}`
+
+	req1 := httptest.NewRequest(http.MethodPost, "/transaction", strings.NewReader(body))
+	req1.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req1.Header.Set(idempotencyHeader, "key-concurrent")
+	rec1 := httptest.NewRecorder()
+	c1 := e.NewContext(req1, rec1)
+
+	req2 := httptest.NewRequest(http.MethodPost, "/transaction", strings.NewReader(body))
+	req2.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req2.Header.Set(idempotencyHeader, "key-concurrent")
+	rec2 := httptest.NewRecorder()
+	c2 := e.NewContext(req2, rec2)
+
+	var err1, err2 error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		err1 = handler(c1)
+	}()
+	go func() {
+		defer wg.Done()
+		err2 = handler(c2)
+	}()
+	wg.Wait()
+
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.Equal(t, http.StatusOK, rec1.Code)
+	assert.Equal(t, http.StatusOK, rec2.Code)
+
+	// どちらか一方だけが業務ロジックを実際に実行し、もう一方はその結果を再生します
+	replayedCount := 0
+	if rec1.Header().Get(idempotencyReplayedHeader) == "true" {
+		replayedCount++
+	}
+	if rec2.Header().Get(idempotencyReplayedHeader) == "true" {
+		replayedCount++
+	}
+	assert.Equal(t, 1, replayedCount)
+	assert.Equal(t, rec1.Body.String(), rec2.Body.String())
+
+	// 振替自体は一度しか実行されていません
+	var senderBalance Balance
+	assert.NoError(t, db.Get(&senderBalance, `SELECT * FROM balances WHERE user_id = 'user1' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.Equal(t, 900, senderBalance.Amount)
+}
+
+func handlerWithIdempotency(db *sqlx.DB) echo.HandlerFunc {
+	return IdempotencyMiddleware(db)(HandleTransaction(db))
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlePostings(t *testing.T) {
+	// テスト用のデータベースをセットアップ
+	db := SetupTestDB()
+	defer db.Close()
+
+	e := echo.New()
+	e.Validator = &CustomValidator{validator: validator.New()}
+
+	for _, tc := range postingsTests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := processPostings(context.Background(), db, tc.request)
+
+			if tc.expectedError != "" {
+				assert.Error(t, err)
+				assert.Equal(t, tc.expectedError, err.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestHandlePostings_SameSourceAcrossMultipleLegs(t *testing.T) {
+	// user1がsourceとして2つのレッグに登場するため、updateBalanceは同一トランザクション内で
+	// (user1, USD)を2回更新します。recorded_atをレッグごとに個別のtime.Now()で
+	// スタンプしないと、balancesの主キー(user_id, asset, valid_from, recorded_at)が
+	// 衝突します(CURRENT_TIMESTAMPはトランザクション開始時刻で固定されるため)
+	db := SetupTestDB()
+	defer db.Close()
+
+	req := PostingsRequest{
+		TransactionID: "test-postings-fanout-same-source",
+		EffectiveDate: time.Now().Add(time.Hour),
+		Postings: []Posting{
+			{Source: "user1", Destination: "user2", Amount: 80, Asset: "USD"},
+			{Source: "user1", Destination: "user3", Amount: 20, Asset: "USD"},
+		},
+	}
+	assert.NoError(t, processPostings(context.Background(), db, req))
+
+	var senderBalance, destBalance1, destBalance2 Balance
+	assert.NoError(t, db.Get(&senderBalance, `SELECT * FROM balances WHERE user_id = 'user1' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.NoError(t, db.Get(&destBalance1, `SELECT * FROM balances WHERE user_id = 'user2' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.NoError(t, db.Get(&destBalance2, `SELECT * FROM balances WHERE user_id = 'user3' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.Equal(t, 900, senderBalance.Amount)
+	assert.Equal(t, 580, destBalance1.Amount)
+	assert.Equal(t, 20, destBalance2.Amount)
+}
+
+func TestValidatePostingsBalance(t *testing.T) {
+	err := validatePostingsBalance([]Posting{
+		{Source: "user1", Destination: "user2", Amount: 80, Asset: "USD"},
+		{Source: "user1", Destination: "user3", Amount: 20, Asset: "USD"},
+	})
+	assert.NoError(t, err)
+}
+
+func TestValidatePostingsBalance_RejectsImbalancedLegs(t *testing.T) {
+	// sourceのみのレッグ(出金)に対応するdestinationのみのレッグ(入金)が無いため、
+	// USDの貸借が一致しません
+	err := validatePostingsBalance([]Posting{
+		{Source: "user1", Amount: 50, Asset: "USD"},
+	})
+	assert.EqualError(t, err, "postings do not net to zero for asset USD")
+}
+
+func TestValidatePostingLegs_RejectsEmptyLeg(t *testing.T) {
+	err := validatePostingLegs([]Posting{
+		{Amount: 50, Asset: "USD"},
+	})
+	assert.EqualError(t, err, "each posting requires a source or a destination")
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// readTimestampHeader はレスポンスへ実効的な読み取り時刻を返すヘッダー名です
+const readTimestampHeader = "X-Read-Timestamp"
+
+// errInvalidMaxStaleness はmax_stalenessクエリパラメータが不正な場合のエラーです
+var errInvalidMaxStaleness = errors.New("Invalid max_staleness")
+
+// defaultMaxStaleness はmax_stalenessクエリパラメータが指定されなかった場合に使う許容遅延です
+const defaultMaxStaleness = 5 * time.Second
+
+// dbReader はsqlx.DBとsqlx.Txの両方が満たす、問い合わせに必要な最小限のインターフェースです
+type dbReader interface {
+	Get(dest interface{}, query string, args ...interface{}) error
+	Select(dest interface{}, query string, args ...interface{}) error
+}
+
+// resolveReadDB はread/max_stalenessクエリパラメータに応じて問い合わせに使うDBを選びます。
+// read=strong(デフォルト)は常にプライマリを読みます。read=bounded_stalenessはレプリカ専用プールを
+// REPEATABLE READ READ ONLYトランザクションで読み、pg_last_xact_replay_timestamp()によるレプリカ遅延が
+// max_stalenessを超えていればプライマリへフォールバックします。
+// 戻り値のfinishは呼び出し側が問い合わせ完了後に必ず呼ぶべき後始末関数です(レプリカのトランザクションを終了します)。
+func resolveReadDB(c echo.Context, primary, replica *sqlx.DB) (reader dbReader, readTimestamp time.Time, finish func(), err error) {
+	readMode := c.QueryParam("read")
+	if readMode == "" {
+		readMode = "strong"
+	}
+	finish = func() {}
+
+	if readMode != "bounded_staleness" || replica == nil {
+		return primary, time.Now(), finish, nil
+	}
+
+	maxStaleness := defaultMaxStaleness
+	if raw := c.QueryParam("max_staleness"); raw != "" {
+		parsed, parseErr := time.ParseDuration(raw)
+		if parseErr != nil {
+			return nil, time.Time{}, finish, errInvalidMaxStaleness
+		}
+		maxStaleness = parsed
+	}
+
+	tx, beginErr := replica.BeginTxx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if beginErr != nil {
+		// レプリカに接続できない場合はプライマリへフォールバックします
+		return primary, time.Now(), finish, nil
+	}
+
+	var replayedAt sql.NullTime
+	if getErr := tx.Get(&replayedAt, "SELECT pg_last_xact_replay_timestamp()"); getErr != nil {
+		tx.Rollback()
+		return primary, time.Now(), finish, nil
+	}
+
+	if !replayedAt.Valid || time.Since(replayedAt.Time) > maxStaleness {
+		// レプリカの遅延がmax_stalenessを超えている(あるいはレプリカではない)ため、プライマリへフォールバックします
+		tx.Rollback()
+		return primary, time.Now(), finish, nil
+	}
+
+	finish = func() { tx.Commit() }
+	return tx, replayedAt.Time, finish, nil
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveReadDB_StrongIsDefault(t *testing.T) {
+	db := SetupTestDB()
+	defer db.Close()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/balance/user1", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	reader, _, finish, err := resolveReadDB(c, db, nil)
+	defer finish()
+
+	assert.NoError(t, err)
+	assert.Equal(t, dbReader(db), reader)
+}
+
+func TestResolveReadDB_FallsBackWithoutReplica(t *testing.T) {
+	db := SetupTestDB()
+	defer db.Close()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/balance/user1?read=bounded_staleness", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	// レプリカプールが設定されていない(nil)場合は、必ずプライマリへフォールバックします
+	reader, _, finish, err := resolveReadDB(c, db, nil)
+	defer finish()
+
+	assert.NoError(t, err)
+	assert.Equal(t, dbReader(db), reader)
+}
+
+func TestResolveReadDB_InvalidMaxStaleness(t *testing.T) {
+	db := SetupTestDB()
+	defer db.Close()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/balance/user1?read=bounded_staleness&max_staleness=not-a-duration", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	_, _, finish, err := resolveReadDB(c, db, db)
+	defer finish()
+
+	assert.Error(t, err)
+}
+
+func TestHandleGetBalance_SetsReadTimestampHeaderOnStrongRead(t *testing.T) {
+	db := SetupTestDB()
+	defer db.Close()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/balance/user1", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("userId")
+	c.SetParamValues("user1")
+
+	assert.NoError(t, HandleGetBalance(db, nil)(c))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get(readTimestampHeader))
+}
+
+func TestHandleGetBalance_BoundedStalenessFallsBackWithoutReplicaLag(t *testing.T) {
+	// SetupTestDB()はレプリカではない(pg_last_xact_replay_timestamp()がNULLを返す)通常の
+	// Postgresなので、read=bounded_stalenessを指定してもresolveReadDBはプライマリへ
+	// フォールバックするはずです。HandleGetBalanceの統合レベルでこれを確認します
+	db := SetupTestDB()
+	defer db.Close()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/balance/user1?read=bounded_staleness", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("userId")
+	c.SetParamValues("user1")
+
+	assert.NoError(t, HandleGetBalance(db, db)(c))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get(readTimestampHeader))
+
+	var balance Balance
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &balance))
+	assert.Equal(t, 1000, balance.Amount)
+}
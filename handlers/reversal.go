@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// farFutureTimestamp はbalances/transaction_historyで「現在も有効/真実」を表す番兵値です
+const farFutureTimestamp = "9999-12-31 23:59:59"
+
+// transactionLeg は残高の再構築時に取引履歴を再生するための1レッグ分の情報です
+type transactionLeg struct {
+	SenderID      string    `db:"sender_id"`
+	ReceiverID    string    `db:"receiver_id"`
+	Amount        int       `db:"amount"`
+	EffectiveDate time.Time `db:"effective_date"`
+}
+
+// HandleReverseTransaction は過去の取引を補正する取消(リバーサル)処理のハンドラーです
+// 補正対象の残高行はUPDATE-in-placeせず、有効期間を閉じた上で新しいセグメントを積み直すことで
+// 監査履歴(いつ何が真実だとされていたか)を失わずに訂正します
+func HandleReverseTransaction(db *sqlx.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		transactionID := c.Param("transaction_id")
+
+		if err := reverseTransaction(db, transactionID); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "取引を取り消しました"})
+	}
+}
+
+// reverseTransaction は取消処理の実際の実装です
+func reverseTransaction(db *sqlx.DB, transactionID string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			log.Printf("Failed to commit transaction: %v", err)
+			return
+		}
+	}()
+
+	// 補正対象の取引を取得します
+	var original TransactionHistory
+	err = tx.Get(&original, `SELECT * FROM transaction_history WHERE transaction_id = $1`, transactionID)
+	if err == sql.ErrNoRows {
+		err = errors.New("Transaction not found")
+		return err
+	}
+	if err != nil {
+		err = errors.New("Failed to get original transaction")
+		return err
+	}
+
+	// 既に取り消し済みでないことを確認します
+	var reversalCount int
+	if err = tx.Get(&reversalCount, `
+    SELECT COUNT(*) FROM transaction_history WHERE reverses_transaction_id = $1
+  `, transactionID); err != nil {
+		err = errors.New("Failed to check existing reversal")
+		return err
+	}
+	if reversalCount > 0 {
+		err = errors.New("Transaction already reversed")
+		return err
+	}
+
+	// 送金者・受取人の排他ロックを取得します
+	if err = acquireLock(tx, []string{original.SenderID, original.ReceiverID}); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	reversalTransactionID := transactionID + "-reversal"
+
+	// 補正用の取引を記録します。amountを反転させることで元の効果を打ち消します
+	if _, err = tx.Exec(`
+    INSERT INTO transaction_history
+      (sender_id, receiver_id, amount, transaction_id, effective_date, recorded_at, reverses_transaction_id)
+    VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, $6)
+  `, original.SenderID, original.ReceiverID, -original.Amount, reversalTransactionID, now, transactionID); err != nil {
+		err = errors.New("Failed to record reversal transaction")
+		return err
+	}
+
+	// 補正時点以降の残高を取引履歴から再生し、積み直します
+	if err = rebuildBalancesFromCorrection(tx, []string{original.SenderID, original.ReceiverID}, defaultAsset, original.EffectiveDate, now); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// rebuildBalancesFromCorrection は、補正時点より後に有効だった残高セグメントを全て supersede した上で、
+// 取引履歴を実効日時順に再生して新しいセグメントとして積み直します。
+// balancesの主キーはrecorded_atを含む(user_id, asset, valid_from, recorded_at)なので、
+// 積み直す新しいセグメントの最初の行がsupersedeされた旧セグメントと同じvalid_from(= from)を
+// 持っていても、recorded_at(= now)が異なるため主キー衝突は起きません
+func rebuildBalancesFromCorrection(tx *sqlx.Tx, userIDs []string, asset string, from time.Time, now time.Time) error {
+	for _, userID := range userIDs {
+		// 補正時点より前の直近の残高を基準値として取得します
+		var baseline Balance
+		if err := tx.Get(&baseline, `
+      SELECT * FROM balances
+      WHERE user_id = $1 AND asset = $2 AND valid_from < $3 AND superseded_at = $4
+      ORDER BY valid_from DESC
+      LIMIT 1
+    `, userID, asset, from, farFutureTimestamp); err != nil {
+			return errors.New("Failed to find baseline balance for correction")
+		}
+
+		// 補正時点以降に有効だったセグメントは、システム時間軸で上書き(supersede)します
+		if _, err := tx.Exec(`
+      UPDATE balances
+      SET superseded_at = $1
+      WHERE user_id = $2 AND asset = $3 AND valid_from >= $4 AND superseded_at = $5
+    `, now, userID, asset, from, farFutureTimestamp); err != nil {
+			return errors.New("Failed to supersede balance segments")
+		}
+
+		// 基準値の行も補正時点で一度閉じ、そこから新しいセグメントを積み直します。
+		// recorded_atも条件に含めることで、同じvalid_fromを持つ行が複数あっても
+		// 基準値そのものだけを更新できるようにします
+		if _, err := tx.Exec(`
+      UPDATE balances
+      SET valid_to = $1
+      WHERE user_id = $2 AND asset = $3 AND valid_from = $4 AND recorded_at = $5
+    `, from, userID, asset, baseline.ValidFrom, baseline.RecordedAt); err != nil {
+			return errors.New("Failed to close baseline balance segment")
+		}
+
+		// 補正時点以降の取引履歴を実効日時順に再生します
+		var legs []transactionLeg
+		if err := tx.Select(&legs, `
+      SELECT sender_id, receiver_id, amount, effective_date FROM transaction_history
+      WHERE (sender_id = $1 OR receiver_id = $1) AND effective_date >= $2
+      ORDER BY effective_date ASC, recorded_at ASC
+    `, userID, from); err != nil {
+			return errors.New("Failed to replay transaction history for correction")
+		}
+
+		amount := baseline.Amount
+		validFrom := from
+		for i, leg := range legs {
+			delta := leg.Amount
+			if leg.SenderID == userID {
+				delta = -delta
+			}
+			amount += delta
+
+			var validTo *time.Time
+			if i+1 < len(legs) {
+				validTo = &legs[i+1].EffectiveDate
+			}
+
+			if _, err := tx.Exec(`
+        INSERT INTO balances (user_id, asset, amount, valid_from, valid_to, recorded_at, superseded_at)
+        VALUES ($1, $2, $3, $4, COALESCE($5, '9999-12-31 23:59:59'::timestamp), $6, '9999-12-31 23:59:59')
+      `, userID, asset, amount, validFrom, validTo, now); err != nil {
+				return errors.New("Failed to insert rebuilt balance segment")
+			}
+
+			if validTo != nil {
+				validFrom = *validTo
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseTransaction(t *testing.T) {
+	db := SetupTestDB()
+	defer db.Close()
+
+	req := TransactionRequest{
+		SenderID:      "user1",
+		ReceiverID:    "user2",
+		Amount:        100,
+		TransactionID: "test-reverse-1",
+		EffectiveDate: time.Now().Add(time.Hour),
+	}
+	assert.NoError(t, processTransaction(context.Background(), db, req))
+
+	var senderBalance, receiverBalance Balance
+	assert.NoError(t, db.Get(&senderBalance, `SELECT * FROM balances WHERE user_id = 'user1' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.NoError(t, db.Get(&receiverBalance, `SELECT * FROM balances WHERE user_id = 'user2' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.Equal(t, 900, senderBalance.Amount)
+	assert.Equal(t, 600, receiverBalance.Amount)
+
+	assert.NoError(t, reverseTransaction(db, "test-reverse-1"))
+
+	assert.NoError(t, db.Get(&senderBalance, `SELECT * FROM balances WHERE user_id = 'user1' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.NoError(t, db.Get(&receiverBalance, `SELECT * FROM balances WHERE user_id = 'user2' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.Equal(t, 1000, senderBalance.Amount)
+	assert.Equal(t, 500, receiverBalance.Amount)
+
+	// 同じ取引を二重に取り消すことはできません
+	assert.EqualError(t, reverseTransaction(db, "test-reverse-1"), "Transaction already reversed")
+}
+
+// getBalanceAt はHandleGetBalanceをsystem_timeクエリパラメータ付きで呼び出し、結果の残高を返します
+func getBalanceAt(t *testing.T, db *sqlx.DB, userID string, systemTime time.Time) Balance {
+	t.Helper()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/balance/"+userID+"?system_time="+systemTime.Format(time.RFC3339Nano), nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("userId")
+	c.SetParamValues(userID)
+
+	assert.NoError(t, HandleGetBalance(db, nil)(c))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var balance Balance
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &balance))
+	return balance
+}
+
+func TestHandleGetBalance_SystemTimeReflectsReversalCorrection(t *testing.T) {
+	// system_timeはビテンポラルのシステム時間軸なので、補正(リバーサル)の前後で
+	// 同じ実効時点についてシステムが「真実」と認識していた残高が変わるはずです
+	db := SetupTestDB()
+	defer db.Close()
+
+	// effective_dateはリバーサルが記録する補正用取引よりも前にしておきます。リバーサルの
+	// 補正用取引は常にreverseTransaction実行時点のtime.Now()を実効日時として記録するため、
+	// これより後の日時にしないと、取引履歴の再生順序(effective_date ASC)が崩れてしまいます
+	req := TransactionRequest{
+		SenderID:      "user1",
+		ReceiverID:    "user2",
+		Amount:        100,
+		TransactionID: "test-reverse-systime-1",
+		EffectiveDate: time.Now(),
+	}
+	assert.NoError(t, processTransaction(context.Background(), db, req))
+
+	beforeReversal := time.Now()
+
+	assert.NoError(t, reverseTransaction(db, "test-reverse-systime-1"))
+
+	afterReversal := time.Now()
+
+	preCorrectionBalance := getBalanceAt(t, db, "user1", beforeReversal)
+	assert.Equal(t, 900, preCorrectionBalance.Amount)
+
+	postCorrectionBalance := getBalanceAt(t, db, "user1", afterReversal)
+	assert.Equal(t, 1000, postCorrectionBalance.Amount)
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"go-transaction-api/script"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ScriptExecuteRequest は振替DSLスクリプトの実行リクエストを表す構造体です
+type ScriptExecuteRequest struct {
+	TransactionID string    `json:"transaction_id" validate:"required"`
+	EffectiveDate time.Time `json:"effective_date" validate:"required"`
+	Script        string    `json:"script" validate:"required"`
+}
+
+// HandleExecuteScript は振替DSLスクリプトを解析・評価し、複数レッグ振替として実行するハンドラーです
+func HandleExecuteScript(db *sqlx.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// リクエストの情報を取得します
+		var req ScriptExecuteRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "リクエストが不正です"})
+		}
+		// リクエストの情報をバリデーションします
+		if err := c.Validate(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "リクエストデータが無効です"})
+		}
+
+		// effective_dateが現在時刻より前の場合はエラーを返します
+		if req.EffectiveDate.Before(time.Now()) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "effective_dateは現在時刻以降の値を指定してください"})
+		}
+
+		// スクリプトを解析します
+		stmt, err := script.Parse(req.Script)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+
+		// スクリプトを評価し、具体的な金額を持つレッグへ展開します
+		legs, err := script.Evaluate(stmt)
+		if err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		}
+
+		postingsReq := PostingsRequest{
+			TransactionID: req.TransactionID,
+			EffectiveDate: req.EffectiveDate,
+			Postings:      legsToPostings(legs),
+		}
+
+		// スクリプトから組み立てたレッグも、/postingsへの直接リクエストと同じ構造検証を通します。
+		// これにより、パーセンテージの端数処理で金額が0になったレッグなどを弾きます
+		if err := c.Validate(&postingsReq); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "リクエストデータが無効です"})
+		}
+
+		// 各レッグがsource/destinationの少なくとも一方を持つことを確認します
+		if err := validatePostingLegs(postingsReq.Postings); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		}
+
+		// 資産ごとに貸借(debit/credit)が一致することを確認します
+		if err := validatePostingsBalance(postingsReq.Postings); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		}
+
+		// 複数レッグ振替として実行します。ユーザー存在確認・ロック・残高更新・冪等性は
+		// processPostingsに委ね、既存の振替パスと完全に統一されます
+		if err := processPostings(c.Request().Context(), db, postingsReq); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "取引が成功しました"})
+	}
+}
+
+// legsToPostings はscript.Leg のスライスをPostingへ変換します
+func legsToPostings(legs []script.Leg) []Posting {
+	postings := make([]Posting, len(legs))
+	for i, leg := range legs {
+		postings[i] = Posting{
+			Source:      leg.Source,
+			Destination: leg.Destination,
+			Amount:      leg.Amount,
+			Asset:       leg.Asset,
+		}
+	}
+	return postings
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-transaction-api/script"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleExecuteScript_FeeSplit(t *testing.T) {
+	db := SetupTestDB()
+	defer db.Close()
+
+	stmt, err := script.Parse("send [USD 100] from @user1 to { 80% to @user2, 20% to @user3 }")
+	assert.NoError(t, err)
+
+	legs, err := script.Evaluate(stmt)
+	assert.NoError(t, err)
+
+	req := PostingsRequest{
+		TransactionID: "test-script-1",
+		EffectiveDate: time.Now().Add(time.Hour),
+		Postings:      legsToPostings(legs),
+	}
+
+	assert.NoError(t, processPostings(context.Background(), db, req))
+
+	var user2Balance, user3Balance Balance
+	assert.NoError(t, db.Get(&user2Balance, `SELECT * FROM balances WHERE user_id = 'user2' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.NoError(t, db.Get(&user3Balance, `SELECT * FROM balances WHERE user_id = 'user3' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.Equal(t, 580, user2Balance.Amount)
+	assert.Equal(t, 20, user3Balance.Amount)
+}
+
+func TestHandleExecuteScript_ThreeWaySplitSameSource(t *testing.T) {
+	// evaluateSplitは3つ以上の配分先でも同じsource(user1)を使い回すため、
+	// updateBalanceは同一トランザクション内で(user1, USD)を3回更新します。
+	// 2レッグのケースだけでなく3レッグ以上でも主キー衝突が起きないことを確認します
+	db := SetupTestDB()
+	defer db.Close()
+
+	stmt, err := script.Parse("send [USD 100] from @user1 to { 50% to @user2, 30% to @user3, 20% to @fees }")
+	assert.NoError(t, err)
+
+	legs, err := script.Evaluate(stmt)
+	assert.NoError(t, err)
+	assert.Len(t, legs, 3)
+
+	req := PostingsRequest{
+		TransactionID: "test-script-three-way",
+		EffectiveDate: time.Now().Add(time.Hour),
+		Postings:      legsToPostings(legs),
+	}
+
+	assert.NoError(t, processPostings(context.Background(), db, req))
+
+	var senderBalance, user2Balance, user3Balance, feesBalance Balance
+	assert.NoError(t, db.Get(&senderBalance, `SELECT * FROM balances WHERE user_id = 'user1' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.NoError(t, db.Get(&user2Balance, `SELECT * FROM balances WHERE user_id = 'user2' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.NoError(t, db.Get(&user3Balance, `SELECT * FROM balances WHERE user_id = 'user3' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.NoError(t, db.Get(&feesBalance, `SELECT * FROM balances WHERE user_id = 'fees' AND valid_to = '9999-12-31 23:59:59'`))
+	assert.Equal(t, 900, senderBalance.Amount)
+	assert.Equal(t, 550, user2Balance.Amount)
+	assert.Equal(t, 30, user3Balance.Amount)
+	assert.Equal(t, 20, feesBalance.Amount)
+}
+
+func TestHandleExecuteScript_InvalidScript(t *testing.T) {
+	_, err := script.Parse("send from @user1 to @user2")
+	assert.Error(t, err)
+}
+
+func TestHandleExecuteScript_RejectsZeroAmountLegFromRounding(t *testing.T) {
+	db := SetupTestDB()
+	defer db.Close()
+
+	e := echo.New()
+	e.Validator = &CustomValidator{validator: validator.New()}
+
+	// 1%分を1 USDに適用すると0に切り捨てられるため、1件目のレッグが0円になります
+	body := `{
+		"transaction_id": "test-script-zero-leg",
+		"effective_date": "2999-01-01T10:00:00Z",
+		"script": "send [USD 1] from @user1 to { 1% to @user2, 99% to @user3 }"
+	}`
+	req := httptest.NewRequest(http.MethodPost, "/scripts/execute", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	assert.NoError(t, HandleExecuteScript(db)(c))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -47,3 +47,47 @@ var transactionTests = []struct {
 		expectedError:  "Insufficient balance",
 	},
 }
+
+var postingsTests = []struct {
+	name           string
+	request        PostingsRequest
+	expectedStatus int
+	expectedError  string
+}{
+	{
+		name: "Valid fan-out postings",
+		request: PostingsRequest{
+			TransactionID: "test-postings-1",
+			EffectiveDate: time.Now().Add(time.Hour),
+			Postings: []Posting{
+				{Source: "user1", Destination: "user2", Amount: 80, Asset: "USD"},
+				{Source: "user1", Destination: "user3", Amount: 20, Asset: "USD"},
+			},
+		},
+		expectedStatus: http.StatusOK,
+	},
+	{
+		name: "Non-existent destination",
+		request: PostingsRequest{
+			TransactionID: "test-postings-2",
+			EffectiveDate: time.Now().Add(time.Hour),
+			Postings: []Posting{
+				{Source: "user1", Destination: "nonexistent", Amount: 50, Asset: "USD"},
+			},
+		},
+		expectedStatus: http.StatusInternalServerError,
+		expectedError:  "User does not exist",
+	},
+	{
+		name: "Insufficient balance across legs",
+		request: PostingsRequest{
+			TransactionID: "test-postings-3",
+			EffectiveDate: time.Now().Add(time.Hour),
+			Postings: []Posting{
+				{Source: "user1", Destination: "user2", Amount: 2000, Asset: "USD"},
+			},
+		},
+		expectedStatus: http.StatusInternalServerError,
+		expectedError:  "Insufficient balance",
+	},
+}
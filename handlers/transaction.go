@@ -1,16 +1,20 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"log"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 )
 
+// defaultAsset は通貨区分を持たない既存の単一資産取引で使われる資産コードです
+const defaultAsset = "USD"
+
 // User はユーザー情報を表す構造体です
 type User struct {
 	UserID   string `db:"user_id" json:"user_id"`
@@ -18,11 +22,17 @@ type User struct {
 }
 
 // Balance は残高情報を表す構造体です
+// valid_from/valid_toは「実際にはいつ有効だったか」を表す実効時間(effective-time)軸、
+// recorded_at/superseded_atは「システムがいつそれを真実だと認識していたか」を表す
+// システム時間(system-time)軸です。この2軸を併せ持つことでビテンポラルな問い合わせができます。
 type Balance struct {
-	UserID    string    `db:"user_id" json:"user_id"`
-	Amount    int       `db:"amount" json:"amount"`
-	ValidFrom time.Time `db:"valid_from" json:"valid_from"`
-	ValidTo   time.Time `db:"valid_to" json:"valid_to"`
+	UserID       string    `db:"user_id" json:"user_id"`
+	Asset        string    `db:"asset" json:"asset"`
+	Amount       int       `db:"amount" json:"amount"`
+	ValidFrom    time.Time `db:"valid_from" json:"valid_from"`
+	ValidTo      time.Time `db:"valid_to" json:"valid_to"`
+	RecordedAt   time.Time `db:"recorded_at" json:"recorded_at"`
+	SupersededAt time.Time `db:"superseded_at" json:"superseded_at"`
 }
 
 // TransactionRequest は取引リクエストの情報を表す構造体です
@@ -34,15 +44,48 @@ type TransactionRequest struct {
 	EffectiveDate time.Time `json:"effective_date" validate:"required"`
 }
 
+// Posting は複式簿記における1レッグ(仕訳行)分の資金移動を表す構造体です
+// SourceとDestinationの両方を指定すると通常の振替(支払い元→支払い先)になり、
+// 片方のみを指定すると外部との入出金(手数料の徴収や外部入金など)を表す片側エントリになります
+type Posting struct {
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Amount      int    `json:"amount" validate:"required,gt=0"`
+	Asset       string `json:"asset" validate:"required"`
+}
+
+// PostingsRequest は複数レッグをまとめて実行する振替リクエストを表す構造体です
+type PostingsRequest struct {
+	TransactionID string                 `json:"transaction_id" validate:"required"`
+	EffectiveDate time.Time              `json:"effective_date" validate:"required"`
+	Postings      []Posting              `json:"postings" validate:"required,min=1,dive"`
+	Metadata      map[string]interface{} `json:"metadata"`
+}
+
+// PostingRecord はpostingsテーブルの1レコードを表す構造体です
+// source_id/destination_idは片側エントリでは一方がNULLになり得ます
+type PostingRecord struct {
+	ID            int            `db:"id" json:"id"`
+	TransactionID string         `db:"transaction_id" json:"transaction_id"`
+	LegIndex      int            `db:"leg_index" json:"leg_index"`
+	SourceID      sql.NullString `db:"source_id" json:"source_id,omitempty"`
+	DestinationID sql.NullString `db:"destination_id" json:"destination_id,omitempty"`
+	Amount        int            `db:"amount" json:"amount"`
+	Asset         string         `db:"asset" json:"asset"`
+	EffectiveDate time.Time      `db:"effective_date" json:"effective_date"`
+	RecordedAt    time.Time      `db:"recorded_at" json:"recorded_at"`
+}
+
 // TransactionHistory は取引履歴の情報を表す構造体です
 type TransactionHistory struct {
-	ID            int       `db:"id" json:"id"`
-	SenderID      string    `db:"sender_id" json:"sender_id"`
-	ReceiverID    string    `db:"receiver_id" json:"receiver_id"`
-	Amount        int       `db:"amount" json:"amount"`
-	TransactionID string    `db:"transaction_id" json:"transaction_id"`
-	EffectiveDate time.Time `db:"effective_date" json:"effective_date"`
-	RecordedAt    time.Time `db:"recorded_at" json:"recorded_at"`
+	ID                    int            `db:"id" json:"id"`
+	SenderID              string         `db:"sender_id" json:"sender_id"`
+	ReceiverID            string         `db:"receiver_id" json:"receiver_id"`
+	Amount                int            `db:"amount" json:"amount"`
+	TransactionID         string         `db:"transaction_id" json:"transaction_id"`
+	EffectiveDate         time.Time      `db:"effective_date" json:"effective_date"`
+	RecordedAt            time.Time      `db:"recorded_at" json:"recorded_at"`
+	ReversesTransactionID sql.NullString `db:"reverses_transaction_id" json:"reverses_transaction_id,omitempty"`
 }
 
 // HandleTransaction は取引処理のハンドラーです
@@ -64,7 +107,7 @@ func HandleTransaction(db *sqlx.DB) echo.HandlerFunc {
 		}
 
 		// 取引処理を実行します
-		if err := processTransaction(db, req); err != nil {
+		if err := processTransaction(c.Request().Context(), db, req); err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		}
 
@@ -73,63 +116,183 @@ func HandleTransaction(db *sqlx.DB) echo.HandlerFunc {
 	}
 }
 
-// processTransaction は取引処理の実際の実装です
-func processTransaction(db *sqlx.DB, req TransactionRequest) error {
-	// トランザクションを開始します
-	tx, err := db.Beginx()
-	if err != nil {
-		return err
-	}
+// HandlePostings は複数レッグ振替(ポスティング)処理のハンドラーです
+func HandlePostings(db *sqlx.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// リクエストの情報を取得します
+		var req PostingsRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "リクエストが不正です"})
+		}
+		// リクエストの情報をバリデーションします
+		if err := c.Validate(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "リクエストデータが無効です"})
+		}
 
-	// トランザクション終了時の処理を定義します
-	defer func() {
-		if err != nil {
-			// エラーがある場合はロールバックします
-			tx.Rollback()
-			return
+		// effective_dateが現在時刻より前の場合はエラーを返します
+		if req.EffectiveDate.Before(time.Now()) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "effective_dateは現在時刻以降の値を指定してください"})
 		}
-		// トランザクションをコミットします
-		err = tx.Commit()
-		if err != nil {
-			log.Printf("Failed to commit transaction: %v", err)
-			return
+
+		// 各レッグがsource/destinationの少なくとも一方を持つことを確認します
+		if err := validatePostingLegs(req.Postings); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
 		}
-	}()
 
-	// ユーザーの存在を確認します
-	if err := checkUserExists(tx, req.SenderID); err != nil {
-		return err
-	}
-	if err := checkUserExists(tx, req.ReceiverID); err != nil {
-		return err
-	}
+		// 資産ごとに貸借(debit/credit)が一致することを確認します
+		if err := validatePostingsBalance(req.Postings); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		}
 
-	// 排他ロックを取得します
-	if err := acquireLock(tx, req.SenderID, req.ReceiverID); err != nil {
-		return err
-	}
+		// 振替処理を実行します
+		if err := processPostings(c.Request().Context(), db, req); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
 
-	// 重複リクエストの判定を行います
-	if err := checkDuplicateTransaction(tx, req.TransactionID); err != nil {
-		return err
+		// 取引成功のレスポンスを返します
+		return c.JSON(http.StatusOK, map[string]string{"message": "取引が成功しました"})
 	}
+}
 
-	// 送金者の残高を更新します
-	if err := updateBalance(tx, req.SenderID, -req.Amount, req.EffectiveDate); err != nil {
-		return err
+// validatePostingLegs は各レッグがsource/destinationの少なくとも一方を持つことを確認します
+func validatePostingLegs(postings []Posting) error {
+	for _, p := range postings {
+		if p.Source == "" && p.Destination == "" {
+			return errors.New("each posting requires a source or a destination")
+		}
 	}
+	return nil
+}
 
-	// 受取人の残高を更新します
-	if err := updateBalance(tx, req.ReceiverID, req.Amount, req.EffectiveDate); err != nil {
-		return err
+// validatePostingsBalance は資産ごとに貸借(debit/credit)の合計が一致することを確認します
+// sourceのみ(片側の出金)・destinationのみ(片側の入金)のレッグは、対応する貸借を
+// 生まないため、この合計が崩れ得ます。両方を持つレッグは常に両側へ同額を積むため中立です。
+func validatePostingsBalance(postings []Posting) error {
+	debits := make(map[string]int)
+	credits := make(map[string]int)
+	for _, p := range postings {
+		if p.Source != "" {
+			debits[p.Asset] += p.Amount
+		}
+		if p.Destination != "" {
+			credits[p.Asset] += p.Amount
+		}
+	}
+	assets := make(map[string]bool, len(debits)+len(credits))
+	for asset := range debits {
+		assets[asset] = true
+	}
+	for asset := range credits {
+		assets[asset] = true
 	}
+	for asset := range assets {
+		if debits[asset] != credits[asset] {
+			return errors.New("postings do not net to zero for asset " + asset)
+		}
+	}
+	return nil
+}
 
-	// 取引履歴を記録します
-	if err := recordTransaction(tx, req); err != nil {
-		return err
+// collectPostingUserIDs はpostingsに登場する全ユーザーIDを重複なく取得します
+func collectPostingUserIDs(postings []Posting) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, p := range postings {
+		for _, id := range []string{p.Source, p.Destination} {
+			if id == "" || seen[id] {
+				continue
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
 	}
+	return ids
+}
 
-	return nil
+// processPostings は複数レッグ振替処理の実際の実装です
+// ctxにIdempotency-Keyミドルウェアが保持するトランザクションがあれば、それを再利用します
+func processPostings(ctx context.Context, db *sqlx.DB, req PostingsRequest) error {
+	return execInTx(ctx, db, func(tx *sqlx.Tx) error {
+		// 関係する全ユーザーの存在を確認します
+		userIDs := collectPostingUserIDs(req.Postings)
+		for _, id := range userIDs {
+			if err := checkUserExists(tx, id); err != nil {
+				return err
+			}
+		}
+
+		// 関係する全ユーザーIDを昇順にソートした上で排他ロックを取得し、デッドロックを防ぎます
+		if err := acquireLock(tx, userIDs); err != nil {
+			return err
+		}
+
+		// 重複リクエストの判定を行います
+		if err := checkDuplicatePostings(tx, req.TransactionID); err != nil {
+			return err
+		}
+
+		// 各レッグについて残高を更新し、postingsテーブルへ記録します。同じユーザーが
+		// 複数レッグに登場してもrecorded_atの主キー衝突が起きないよう、レッグごとに
+		// 個別のtime.Now()を渡します
+		for legIndex, p := range req.Postings {
+			if p.Source != "" {
+				if err := updateBalance(tx, p.Source, -p.Amount, p.Asset, req.EffectiveDate, time.Now()); err != nil {
+					return err
+				}
+			}
+			if p.Destination != "" {
+				if err := updateBalance(tx, p.Destination, p.Amount, p.Asset, req.EffectiveDate, time.Now()); err != nil {
+					return err
+				}
+			}
+			if err := recordPosting(tx, req, p, legIndex); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// processTransaction は取引処理の実際の実装です
+// ctxにIdempotency-Keyミドルウェアが保持するトランザクションがあれば、それを再利用します
+func processTransaction(ctx context.Context, db *sqlx.DB, req TransactionRequest) error {
+	return execInTx(ctx, db, func(tx *sqlx.Tx) error {
+		// ユーザーの存在を確認します
+		if err := checkUserExists(tx, req.SenderID); err != nil {
+			return err
+		}
+		if err := checkUserExists(tx, req.ReceiverID); err != nil {
+			return err
+		}
+
+		// 排他ロックを取得します
+		if err := acquireLock(tx, []string{req.SenderID, req.ReceiverID}); err != nil {
+			return err
+		}
+
+		// 重複リクエストの判定を行います
+		if err := checkDuplicateTransaction(tx, req.TransactionID); err != nil {
+			return err
+		}
+
+		// 送金者の残高を更新します
+		if err := updateBalance(tx, req.SenderID, -req.Amount, defaultAsset, req.EffectiveDate, time.Now()); err != nil {
+			return err
+		}
+
+		// 受取人の残高を更新します
+		if err := updateBalance(tx, req.ReceiverID, req.Amount, defaultAsset, req.EffectiveDate, time.Now()); err != nil {
+			return err
+		}
+
+		// 取引履歴を記録します
+		if err := recordTransaction(tx, req); err != nil {
+			return err
+		}
+
+		return nil
+	})
 }
 
 // checkUserExists はユーザーの存在を確認します
@@ -145,14 +308,11 @@ func checkUserExists(tx *sqlx.Tx, userID string) error {
 	return nil
 }
 
-// acquireLock は排他ロックを取得します
-func acquireLock(tx *sqlx.Tx, senderID, receiverID string) error {
-	// 送金者と受取人のIDを昇順にソートしてロックを取得します
-	// これにより、デッドロックを防ぎます
-	ids := []string{senderID, receiverID}
-	if senderID > receiverID {
-		ids[0], ids[1] = receiverID, senderID
-	}
+// acquireLock は関係する全ユーザーIDを昇順にソートした上で排他ロックを取得します
+// これにより、複数ユーザーが関わる振替同士のデッドロックを防ぎます
+func acquireLock(tx *sqlx.Tx, userIDs []string) error {
+	ids := append([]string(nil), userIDs...)
+	sort.Strings(ids)
 
 	for _, id := range ids {
 		_, err := tx.Exec("SELECT * FROM balances WHERE user_id = $1 FOR UPDATE", id)
@@ -177,14 +337,32 @@ func checkDuplicateTransaction(tx *sqlx.Tx, transactionID string) error {
 	return nil
 }
 
+// checkDuplicatePostings は振替IDの重複リクエストをチェックします
+func checkDuplicatePostings(tx *sqlx.Tx, transactionID string) error {
+	var count int
+	err := tx.Get(&count, "SELECT COUNT(*) FROM postings WHERE transaction_id = $1", transactionID)
+	if err != nil {
+		return errors.New("Failed to check duplicate transaction")
+	}
+	if count > 0 {
+		return errors.New("Duplicate transaction")
+	}
+	return nil
+}
+
 // updateBalance は残高を更新します
-func updateBalance(tx *sqlx.Tx, userID string, amount int, effectiveDate time.Time) error {
+// recordedAtは呼び出し元がリーグごとに別個のtime.Now()を渡します。Postgresの
+// CURRENT_TIMESTAMPはトランザクション開始時刻で固定されるため、同一トランザクション内で
+// 同じ(user_id, asset)を複数回更新する(例: 1人の送金者から複数の受取人への分割送金)場合、
+// SQL側のデフォルトに任せると全ての新規行が同じrecorded_atを持ち、
+// balancesの主キー(user_id, asset, valid_from, recorded_at)が衝突してしまいます。
+func updateBalance(tx *sqlx.Tx, userID string, amount int, asset string, effectiveDate time.Time, recordedAt time.Time) error {
 	// 現在の有効な残高レコードを取得します
 	var currentBalance Balance
 	err := tx.Get(&currentBalance, `
-    SELECT * FROM balances 
-    WHERE user_id = $1 AND valid_to = '9999-12-31 23:59:59'
-  `, userID)
+    SELECT * FROM balances
+    WHERE user_id = $1 AND asset = $2 AND valid_to = '9999-12-31 23:59:59'
+  `, userID, asset)
 	if err != nil {
 		return errors.New("Failed to get current balance")
 	}
@@ -197,19 +375,19 @@ func updateBalance(tx *sqlx.Tx, userID string, amount int, effectiveDate time.Ti
 
 	// 現在のレコードの有効期間を更新します
 	_, err = tx.Exec(`
-    UPDATE balances 
-    SET valid_to = $1 
-    WHERE user_id = $2 AND valid_to = '9999-12-31 23:59:59'
-  `, effectiveDate, userID)
+    UPDATE balances
+    SET valid_to = $1
+    WHERE user_id = $2 AND asset = $3 AND valid_to = '9999-12-31 23:59:59'
+  `, effectiveDate, userID, asset)
 	if err != nil {
 		return errors.New("Failed to update current balance record")
 	}
 
 	// 新しい残高レコードを挿入します
 	_, err = tx.Exec(`
-    INSERT INTO balances (user_id, amount, valid_from, valid_to) 
-    VALUES ($1, $2, $3, '9999-12-31 23:59:59')
-  `, userID, newAmount, effectiveDate)
+    INSERT INTO balances (user_id, asset, amount, valid_from, valid_to, recorded_at)
+    VALUES ($1, $2, $3, $4, '9999-12-31 23:59:59', $5)
+  `, userID, asset, newAmount, effectiveDate, recordedAt)
 	if err != nil {
 		return errors.New("Failed to insert new balance record")
 	}
@@ -229,27 +407,72 @@ func recordTransaction(tx *sqlx.Tx, req TransactionRequest) error {
 	return nil
 }
 
+// recordPosting は振替の1レッグをpostingsテーブルへ記録します
+// source/destinationが片側のみのレッグでは、欠けている側をNULLとして記録します
+func recordPosting(tx *sqlx.Tx, req PostingsRequest, p Posting, legIndex int) error {
+	var source, destination sql.NullString
+	if p.Source != "" {
+		source = sql.NullString{String: p.Source, Valid: true}
+	}
+	if p.Destination != "" {
+		destination = sql.NullString{String: p.Destination, Valid: true}
+	}
+	_, err := tx.Exec(`
+    INSERT INTO postings (transaction_id, leg_index, source_id, destination_id, amount, asset, effective_date, recorded_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, CURRENT_TIMESTAMP)
+  `, req.TransactionID, legIndex, source, destination, p.Amount, p.Asset, req.EffectiveDate)
+	if err != nil {
+		return errors.New("Failed to record posting")
+	}
+	return nil
+}
+
 // HandleGetBalance は残高照会のハンドラーです
-func HandleGetBalance(db *sqlx.DB) echo.HandlerFunc {
+// as_ofは実効時間(effective-time)軸、system_timeはシステム時間(system-time)軸の問い合わせで、
+// 両者を組み合わせることで「その時点で、システムはいつの時点の残高だと思っていたか」が分かります。
+// さらにread=bounded_stalenessを指定すると、レプリカの遅延がmax_staleness以内であればレプリカから読みます
+func HandleGetBalance(primary, replica *sqlx.DB) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		userID := c.Param("userId")
 		asOf := c.QueryParam("as_of")
+		systemTime := c.QueryParam("system_time")
+
+		db, readTimestamp, finish, err := resolveReadDB(c, primary, replica)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		defer finish()
+		c.Response().Header().Set(readTimestampHeader, readTimestamp.Format(time.RFC3339))
 
 		var balance Balance
-		var err error
 
-		if asOf == "" {
-			// as_ofパラメータが指定されていない場合は現在の残高を取得
+		switch {
+		case asOf == "" && systemTime == "":
+			// どちらも指定されていない場合は現在の残高を取得
 			err = db.Get(&balance, `
         SELECT * FROM balances
-        WHERE user_id = $1 AND valid_to = '9999-12-31 23:59:59'
+        WHERE user_id = $1 AND valid_to = '9999-12-31 23:59:59' AND superseded_at = '9999-12-31 23:59:59'
       `, userID)
-		} else {
-			// as_ofパラメータが指定されている場合はその時点での残高を取得
+		case systemTime == "":
+			// as_ofのみ指定されている場合はその実効時刻時点での最新の認識を取得
 			err = db.Get(&balance, `
         SELECT * FROM balances
-        WHERE user_id = $1 AND valid_from <= $2 AND valid_to > $2
+        WHERE user_id = $1 AND valid_from <= $2 AND valid_to > $2 AND superseded_at = '9999-12-31 23:59:59'
       `, userID, asOf)
+		case asOf == "":
+			// system_timeのみ指定されている場合は、その時刻にシステムが真実だと認識していた残高を取得
+			err = db.Get(&balance, `
+        SELECT * FROM balances
+        WHERE user_id = $1 AND recorded_at <= $2 AND superseded_at > $2
+        ORDER BY valid_from DESC
+        LIMIT 1
+      `, userID, systemTime)
+		default:
+			// 両方指定されている場合は、system_time時点でシステムが認識していた、as_of時点の残高を取得
+			err = db.Get(&balance, `
+        SELECT * FROM balances
+        WHERE user_id = $1 AND valid_from <= $2 AND valid_to > $2 AND recorded_at <= $3 AND superseded_at > $3
+      `, userID, asOf, systemTime)
 		}
 
 		if err == sql.ErrNoRows {
@@ -263,28 +486,51 @@ func HandleGetBalance(db *sqlx.DB) echo.HandlerFunc {
 }
 
 // HandleGetTransactionHistory は取引履歴照会のハンドラーです
-func HandleGetTransactionHistory(db *sqlx.DB) echo.HandlerFunc {
+// as_ofは実効時間(effective-time, いつ起きた取引か)、system_timeはシステム時間(system-time,
+// いつシステムに記録されたか)の軸で絞り込みます。read=bounded_stalenessにも対応します
+func HandleGetTransactionHistory(primary, replica *sqlx.DB) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		userID := c.Param("userId")
 		asOf := c.QueryParam("as_of")
+		systemTime := c.QueryParam("system_time")
+
+		db, readTimestamp, finish, err := resolveReadDB(c, primary, replica)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		defer finish()
+		c.Response().Header().Set(readTimestampHeader, readTimestamp.Format(time.RFC3339))
 
 		var history []TransactionHistory
-		var err error
 
-		if asOf == "" {
-			// as_ofパラメータが指定されていない場合は全ての取引履歴を取得
+		switch {
+		case asOf == "" && systemTime == "":
+			// どちらも指定されていない場合は全ての取引履歴を取得
 			err = db.Select(&history, `
         SELECT * FROM transaction_history
         WHERE sender_id = $1 OR receiver_id = $1
         ORDER BY effective_date DESC, recorded_at DESC
       `, userID)
-		} else {
-			// as_ofパラメータが指定されている場合はその時点までの取引履歴を取得
+		case systemTime == "":
+			// as_ofのみ指定されている場合はその実効日時までの取引履歴を取得
 			err = db.Select(&history, `
         SELECT * FROM transaction_history
         WHERE (sender_id = $1 OR receiver_id = $1) AND effective_date <= $2
         ORDER BY effective_date DESC, recorded_at DESC
       `, userID, asOf)
+		case asOf == "":
+			// system_timeのみ指定されている場合は、その時刻までにシステムへ記録された取引履歴を取得
+			err = db.Select(&history, `
+        SELECT * FROM transaction_history
+        WHERE (sender_id = $1 OR receiver_id = $1) AND recorded_at <= $2
+        ORDER BY effective_date DESC, recorded_at DESC
+      `, userID, systemTime)
+		default:
+			err = db.Select(&history, `
+        SELECT * FROM transaction_history
+        WHERE (sender_id = $1 OR receiver_id = $1) AND effective_date <= $2 AND recorded_at <= $3
+        ORDER BY effective_date DESC, recorded_at DESC
+      `, userID, asOf, systemTime)
 		}
 
 		if err != nil {
@@ -170,6 +170,8 @@ func SetupTestDB() *sqlx.DB {
 	db.SetConnMaxLifetime(5 * time.Minute)
 
 	// テーブルを削除します
+	db.MustExec(`DROP TABLE IF EXISTS idempotency_keys`)
+	db.MustExec(`DROP TABLE IF EXISTS postings`)
 	db.MustExec(`DROP TABLE IF EXISTS transaction_history`)
 	db.MustExec(`DROP TABLE IF EXISTS balances`)
 	db.MustExec(`DROP TABLE IF EXISTS users`)
@@ -184,10 +186,13 @@ func SetupTestDB() *sqlx.DB {
 	db.MustExec(`
 		CREATE TABLE balances (
 			user_id VARCHAR(255) REFERENCES users(user_id),
+			asset VARCHAR(16) NOT NULL DEFAULT 'USD',
 			amount INTEGER NOT NULL,
 			valid_from TIMESTAMP NOT NULL,
 			valid_to TIMESTAMP NOT NULL,
-			PRIMARY KEY (user_id, valid_from)
+			recorded_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			superseded_at TIMESTAMP NOT NULL DEFAULT '9999-12-31 23:59:59',
+			PRIMARY KEY (user_id, asset, valid_from, recorded_at)
 		)
 	`)
 	db.MustExec(`
@@ -198,7 +203,31 @@ func SetupTestDB() *sqlx.DB {
 			amount INTEGER NOT NULL,
 			transaction_id VARCHAR(255) NOT NULL UNIQUE,
 			effective_date TIMESTAMP NOT NULL,
-			recorded_at TIMESTAMP NOT NULL
+			recorded_at TIMESTAMP NOT NULL,
+			reverses_transaction_id VARCHAR(255) REFERENCES transaction_history(transaction_id)
+		)
+	`)
+	db.MustExec(`
+		CREATE TABLE postings (
+			id SERIAL PRIMARY KEY,
+			transaction_id VARCHAR(255) NOT NULL,
+			leg_index INTEGER NOT NULL,
+			source_id VARCHAR(255) REFERENCES users(user_id),
+			destination_id VARCHAR(255) REFERENCES users(user_id),
+			amount INTEGER NOT NULL,
+			asset VARCHAR(16) NOT NULL,
+			effective_date TIMESTAMP NOT NULL,
+			recorded_at TIMESTAMP NOT NULL,
+			UNIQUE (transaction_id, leg_index)
+		)
+	`)
+	db.MustExec(`
+		CREATE TABLE idempotency_keys (
+			idempotency_key VARCHAR(255) PRIMARY KEY,
+			fingerprint VARCHAR(64) NOT NULL,
+			status_code INTEGER,
+			response_body TEXT,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 		)
 	`)
 
@@ -206,12 +235,14 @@ func SetupTestDB() *sqlx.DB {
 	db.MustExec(`
 		INSERT INTO users (user_id, username) VALUES
 		('user1', 'User 1'),
-		('user2', 'User 2')
+		('user2', 'User 2'),
+		('user3', 'User 3')
 	`)
 	db.MustExec(`
-		INSERT INTO balances (user_id, amount, valid_from, valid_to) VALUES
-		('user1', 1000, '2023-01-01 00:00:00', '9999-12-31 23:59:59'),
-		('user2', 500, '2023-01-01 00:00:00', '9999-12-31 23:59:59')
+		INSERT INTO balances (user_id, asset, amount, valid_from, valid_to) VALUES
+		('user1', 'USD', 1000, '2023-01-01 00:00:00', '9999-12-31 23:59:59'),
+		('user2', 'USD', 500, '2023-01-01 00:00:00', '9999-12-31 23:59:59'),
+		('user3', 'USD', 0, '2023-01-01 00:00:00', '9999-12-31 23:59:59')
 	`)
 
 	return db
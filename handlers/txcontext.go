@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"context"
+	"log"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sharedTx は、Idempotency-Keyミドルウェアが保持するDBトランザクションを、
+// リクエストコンテキスト経由で業務ロジックと共有するためのラッパーです。
+// failedは業務ロジックがエラーを返したことをミドルウェアへ伝える目印で、
+// これによりミドルウェアはidempotencyレコードを確定させずロールバックすべきと判断できます
+type sharedTx struct {
+	tx     *sqlx.Tx
+	failed bool
+}
+
+type sharedTxContextKey struct{}
+
+// contextWithTx はctxにsharedTxを紐付けます
+func contextWithTx(ctx context.Context, shared *sharedTx) context.Context {
+	return context.WithValue(ctx, sharedTxContextKey{}, shared)
+}
+
+// sharedTxFromContext はctxに紐付けられたsharedTxを取り出します
+func sharedTxFromContext(ctx context.Context) (*sharedTx, bool) {
+	shared, ok := ctx.Value(sharedTxContextKey{}).(*sharedTx)
+	return shared, ok
+}
+
+// execInTx はctxにIdempotency-Keyミドルウェアが保持するトランザクションがあればそれを再利用し
+// (コミット/ロールバックは呼び出し元であるミドルウェアに委ねます)、無ければ新しいトランザクションを
+// 開始して自身でコミット/ロールバックを行います。これにより、冪等性の記録と残高更新を
+// 同一トランザクションでアトミックにコミットできます
+func execInTx(ctx context.Context, db *sqlx.DB, fn func(tx *sqlx.Tx) error) error {
+	if shared, ok := sharedTxFromContext(ctx); ok {
+		if err := fn(shared.tx); err != nil {
+			shared.failed = true
+			return err
+		}
+		return nil
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to commit transaction: %v", err)
+		return err
+	}
+
+	return nil
+}
@@ -17,6 +17,10 @@ import (
 // グローバル変数
 var db *sqlx.DB
 
+// dbReplica は read=bounded_staleness の問い合わせに使うレプリカ専用の接続プールです
+// DB_REPLICA_HOSTが未設定の場合はnilのままとなり、常にプライマリへフォールバックします
+var dbReplica *sqlx.DB
+
 // CustomValidator はEchoのカスタムバリデータです
 type CustomValidator struct {
 	validator *validator.Validate
@@ -53,6 +57,19 @@ func init() {
 	db.SetMaxOpenConns(25)
 	db.SetMaxIdleConns(25)
 	db.SetConnMaxLifetime(5 * time.Minute)
+
+	// レプリカのホストが指定されている場合のみ、bounded_staleness読み取り用のプールを用意します
+	if dbReplicaHost := os.Getenv("DB_REPLICA_HOST"); dbReplicaHost != "" {
+		var replicaErr error
+		dbReplica, replicaErr = sqlx.Connect("postgres",
+			"host="+dbReplicaHost+" port="+dbPort+" user="+dbUser+" password="+dbPassword+" dbname="+dbName+" sslmode=disable")
+		if replicaErr != nil {
+			log.Fatalf("Failed to connect to replica database: %v", replicaErr)
+		}
+		dbReplica.SetMaxOpenConns(25)
+		dbReplica.SetMaxIdleConns(25)
+		dbReplica.SetConnMaxLifetime(5 * time.Minute)
+	}
 }
 
 func main() {
@@ -62,14 +79,23 @@ func main() {
 	// カスタムバリデータを設定します
 	e.Validator = &CustomValidator{validator: validator.New()}
 
-	// 取引用のエンドポイントを設定します
-	e.POST("/transaction", handlers.HandleTransaction(db))
+	// 取引用のエンドポイントを設定します。Idempotency-Keyヘッダーによるレスポンス再生に対応します
+	e.POST("/transaction", handlers.HandleTransaction(db), handlers.IdempotencyMiddleware(db))
+
+	// 複数レッグ振替(ポスティング)用のエンドポイントを設定します。同じくIdempotency-Keyに対応します
+	e.POST("/postings", handlers.HandlePostings(db), handlers.IdempotencyMiddleware(db))
+
+	// 残高照会用のエンドポイントを設定します。read=bounded_stalenessでレプリカからの読み取りに対応します
+	e.GET("/balance/:userId", handlers.HandleGetBalance(db, dbReplica))
+
+	// 取引履歴照会用のエンドポイントを設定します。同じくread=bounded_stalenessに対応します
+	e.GET("/transaction-history/:userId", handlers.HandleGetTransactionHistory(db, dbReplica))
 
-	// 残高照会用のエンドポイントを設定します
-	e.GET("/balance/:userId", handlers.HandleGetBalance(db))
+	// 過去の取引を補正する取消(リバーサル)用のエンドポイントを設定します
+	e.POST("/transaction/:transaction_id/reverse", handlers.HandleReverseTransaction(db))
 
-	// 取引履歴照会用のエンドポイントを設定します
-	e.GET("/transaction-history/:userId", handlers.HandleGetTransactionHistory(db))
+	// 振替DSLスクリプトの実行用エンドポイントを設定します。同じくIdempotency-Keyに対応します
+	e.POST("/scripts/execute", handlers.HandleExecuteScript(db), handlers.IdempotencyMiddleware(db))
 
 	// サーバーを起動します
 	e.Start(":8080")
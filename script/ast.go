@@ -0,0 +1,54 @@
+package script
+
+// SendStmt は "send [ASSET AMOUNT] from SOURCE to DEST" 文を表すASTのルートノードです
+type SendStmt struct {
+	Asset  string
+	Amount int
+	Source SourceExpr
+	Dest   DestExpr
+}
+
+// SourceExpr は送金元を表すASTノードです
+type SourceExpr interface {
+	sourceExpr()
+}
+
+// SourceAccount は単一アカウントからの送金を表します(例: @user1)
+type SourceAccount struct {
+	Account string
+}
+
+func (SourceAccount) sourceExpr() {}
+
+// SourceMax は上限付きのアカウントからの送金を表します(例: @user1 max [USD 100])
+type SourceMax struct {
+	Account string
+	Cap     int
+}
+
+func (SourceMax) sourceExpr() {}
+
+// DestExpr は送金先を表すASTノードです
+type DestExpr interface {
+	destExpr()
+}
+
+// DestAccount は単一アカウントへの送金を表します(例: @user2)
+type DestAccount struct {
+	Account string
+}
+
+func (DestAccount) destExpr() {}
+
+// DestSplit は複数アカウントへのパーセンテージ按分を表します(例: { 80% to @user2, 20% to @fees })
+type DestSplit struct {
+	Portions []Portion
+}
+
+func (DestSplit) destExpr() {}
+
+// Portion はDestSplitの1配分先を表します。Percentは0〜100のパーセンテージです
+type Portion struct {
+	Account string
+	Percent float64
+}
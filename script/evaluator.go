@@ -0,0 +1,81 @@
+package script
+
+import (
+	"fmt"
+	"math"
+)
+
+// percentEpsilon は按分率の合計が100%かどうかを判定する際の許容誤差です。
+// float64の丸め誤差(例: 0.01 + 64.04 + 35.95 = 100.00000000000001)で
+// 正当な入力が拒否されないようにします
+const percentEpsilon = 1e-9
+
+// Leg は SendStmt の評価結果として得られる、1件の送金元→送金先の資金移動を表します
+// handlers.Posting と同じ形をしており、そのまま複数レッグ振替の実行パスへ渡せます
+type Leg struct {
+	Source      string
+	Destination string
+	Amount      int
+	Asset       string
+}
+
+// Evaluate は SendStmt を具体的な整数金額のレッグへ解決します。パーセンテージによる按分は、
+// 合計が必ずAmountと一致するよう、最後の受取人が端数を吸収するルールで整数化します
+func Evaluate(stmt *SendStmt) ([]Leg, error) {
+	source, err := resolveSource(stmt.Source, stmt.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	switch dest := stmt.Dest.(type) {
+	case DestAccount:
+		return []Leg{{Source: source, Destination: dest.Account, Amount: stmt.Amount, Asset: stmt.Asset}}, nil
+	case DestSplit:
+		return evaluateSplit(source, stmt.Amount, stmt.Asset, dest.Portions)
+	default:
+		return nil, fmt.Errorf("script: unsupported destination expression %T", stmt.Dest)
+	}
+}
+
+func resolveSource(source SourceExpr, amount int) (string, error) {
+	switch src := source.(type) {
+	case SourceAccount:
+		return src.Account, nil
+	case SourceMax:
+		if amount > src.Cap {
+			return "", fmt.Errorf("script: amount %d exceeds source cap %d for @%s", amount, src.Cap, src.Account)
+		}
+		return src.Account, nil
+	default:
+		return "", fmt.Errorf("script: unsupported source expression %T", source)
+	}
+}
+
+func evaluateSplit(source string, amount int, asset string, portions []Portion) ([]Leg, error) {
+	if len(portions) == 0 {
+		return nil, fmt.Errorf("script: destination split has no portions")
+	}
+
+	var totalPercent float64
+	for _, p := range portions {
+		totalPercent += p.Percent
+	}
+	if math.Abs(totalPercent-100) > percentEpsilon {
+		return nil, fmt.Errorf("script: destination split percentages sum to %v, not 100", totalPercent)
+	}
+
+	legs := make([]Leg, len(portions))
+	remaining := amount
+	for i, p := range portions {
+		legAmount := int(float64(amount) * p.Percent / 100)
+		if i == len(portions)-1 {
+			// 最後の受取人が端数を吸収し、合計が必ずAmountと一致するようにします
+			legAmount = remaining
+		} else {
+			remaining -= legAmount
+		}
+		legs[i] = Leg{Source: source, Destination: p.Account, Amount: legAmount, Asset: asset}
+	}
+
+	return legs, nil
+}
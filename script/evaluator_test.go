@@ -0,0 +1,67 @@
+package script
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluate_FeeSplitRemainderAbsorption(t *testing.T) {
+	stmt, err := Parse("send [USD 501] from @user1 to { 80% to @user2, 20% to @fees }")
+	assert.NoError(t, err)
+
+	legs, err := Evaluate(stmt)
+	assert.NoError(t, err)
+
+	assert.Len(t, legs, 2)
+	assert.Equal(t, Leg{Source: "user1", Destination: "user2", Amount: 400, Asset: "USD"}, legs[0])
+	// 20%の厳密な値は100.2だが、最後の受取人が端数を吸収するため101になり、合計は501のままです
+	assert.Equal(t, Leg{Source: "user1", Destination: "fees", Amount: 101, Asset: "USD"}, legs[1])
+
+	total := 0
+	for _, leg := range legs {
+		total += leg.Amount
+	}
+	assert.Equal(t, stmt.Amount, total)
+}
+
+func TestEvaluate_SingleDestination(t *testing.T) {
+	stmt, err := Parse("send [USD 100] from @user1 to @user2")
+	assert.NoError(t, err)
+
+	legs, err := Evaluate(stmt)
+	assert.NoError(t, err)
+	assert.Equal(t, []Leg{{Source: "user1", Destination: "user2", Amount: 100, Asset: "USD"}}, legs)
+}
+
+func TestEvaluate_PercentagesMustSumTo100(t *testing.T) {
+	stmt, err := Parse("send [USD 100] from @user1 to { 80% to @user2, 10% to @fees }")
+	assert.NoError(t, err)
+
+	_, err = Evaluate(stmt)
+	assert.Error(t, err)
+}
+
+func TestEvaluate_PercentagesToleratesFloatRoundingError(t *testing.T) {
+	// 0.01 + 64.04 + 35.95はfloat64では100.00000000000001になりますが、
+	// これは正当な100%の分割として受理されるべきです
+	stmt, err := Parse("send [USD 10000] from @user1 to { 0.01% to @fees, 64.04% to @user2, 35.95% to @user3 }")
+	assert.NoError(t, err)
+
+	legs, err := Evaluate(stmt)
+	assert.NoError(t, err)
+
+	total := 0
+	for _, leg := range legs {
+		total += leg.Amount
+	}
+	assert.Equal(t, stmt.Amount, total)
+}
+
+func TestEvaluate_SourceMaxExceeded(t *testing.T) {
+	stmt, err := Parse("send [USD 300] from @user1 max [USD 200] to @user2")
+	assert.NoError(t, err)
+
+	_, err = Evaluate(stmt)
+	assert.Error(t, err)
+}
@@ -0,0 +1,105 @@
+package script
+
+import (
+	"fmt"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenAt
+	tokenPercent
+	tokenLBracket
+	tokenRBracket
+	tokenLBrace
+	tokenRBrace
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// lexer はDSLの入力文字列を走査してトークンへ分割する字句解析器です
+type lexer struct {
+	input []rune
+	pos   int
+}
+
+func newLexer(input string) *lexer {
+	return &lexer{input: []rune(input)}
+}
+
+func (l *lexer) current() rune {
+	if l.pos >= len(l.input) {
+		return 0
+	}
+	return l.input[l.pos]
+}
+
+func (l *lexer) skipWhitespace() {
+	for l.pos < len(l.input) && unicode.IsSpace(l.input[l.pos]) {
+		l.pos++
+	}
+}
+
+// next は次のトークンを1つ読み進めて返します
+func (l *lexer) next() (token, error) {
+	l.skipWhitespace()
+
+	if l.pos >= len(l.input) {
+		return token{kind: tokenEOF}, nil
+	}
+
+	c := l.current()
+	switch {
+	case c == '@':
+		l.pos++
+		return token{kind: tokenAt, text: "@"}, nil
+	case c == '%':
+		l.pos++
+		return token{kind: tokenPercent, text: "%"}, nil
+	case c == '[':
+		l.pos++
+		return token{kind: tokenLBracket, text: "["}, nil
+	case c == ']':
+		l.pos++
+		return token{kind: tokenRBracket, text: "]"}, nil
+	case c == '{':
+		l.pos++
+		return token{kind: tokenLBrace, text: "{"}, nil
+	case c == '}':
+		l.pos++
+		return token{kind: tokenRBrace, text: "}"}, nil
+	case c == ',':
+		l.pos++
+		return token{kind: tokenComma, text: ","}, nil
+	case unicode.IsDigit(c):
+		return l.readNumber(), nil
+	case unicode.IsLetter(c) || c == '_':
+		return l.readIdent(), nil
+	default:
+		return token{}, fmt.Errorf("script: unexpected character %q", c)
+	}
+}
+
+func (l *lexer) readNumber() token {
+	start := l.pos
+	for l.pos < len(l.input) && (unicode.IsDigit(l.input[l.pos]) || l.input[l.pos] == '.') {
+		l.pos++
+	}
+	return token{kind: tokenNumber, text: string(l.input[start:l.pos])}
+}
+
+func (l *lexer) readIdent() token {
+	start := l.pos
+	for l.pos < len(l.input) && (unicode.IsLetter(l.input[l.pos]) || unicode.IsDigit(l.input[l.pos]) || l.input[l.pos] == '_') {
+		l.pos++
+	}
+	return token{kind: tokenIdent, text: string(l.input[start:l.pos])}
+}
@@ -0,0 +1,223 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// parser はDSLのトークン列から SendStmt のASTを組み立てる再帰下降パーサーです
+type parser struct {
+	lex *lexer
+	cur token
+}
+
+// Parse は "send [ASSET AMOUNT] from SOURCE to DEST" 形式のDSL文字列を解析し、
+// SendStmt のASTを返します
+func Parse(input string) (*SendStmt, error) {
+	p := &parser{lex: newLexer(input)}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	return p.parseSendStmt()
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.cur = tok
+	return nil
+}
+
+func (p *parser) expectIdent(text string) error {
+	if p.cur.kind != tokenIdent || p.cur.text != text {
+		return fmt.Errorf("script: expected %q, got %q", text, p.cur.text)
+	}
+	return p.advance()
+}
+
+func (p *parser) parseSendStmt() (*SendStmt, error) {
+	if err := p.expectIdent("send"); err != nil {
+		return nil, err
+	}
+
+	asset, amount, err := p.parseAmount()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expectIdent("from"); err != nil {
+		return nil, err
+	}
+
+	source, err := p.parseSource()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expectIdent("to"); err != nil {
+		return nil, err
+	}
+
+	dest, err := p.parseDest()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.cur.kind != tokenEOF {
+		return nil, fmt.Errorf("script: unexpected trailing token %q", p.cur.text)
+	}
+
+	return &SendStmt{Asset: asset, Amount: amount, Source: source, Dest: dest}, nil
+}
+
+func (p *parser) parseAmount() (asset string, amount int, err error) {
+	if p.cur.kind != tokenLBracket {
+		return "", 0, fmt.Errorf("script: expected '[', got %q", p.cur.text)
+	}
+	if err = p.advance(); err != nil {
+		return "", 0, err
+	}
+
+	if p.cur.kind != tokenIdent {
+		return "", 0, fmt.Errorf("script: expected asset code, got %q", p.cur.text)
+	}
+	asset = p.cur.text
+	if err = p.advance(); err != nil {
+		return "", 0, err
+	}
+
+	if p.cur.kind != tokenNumber {
+		return "", 0, fmt.Errorf("script: expected amount, got %q", p.cur.text)
+	}
+	amount, convErr := strconv.Atoi(p.cur.text)
+	if convErr != nil {
+		return "", 0, fmt.Errorf("script: invalid amount %q", p.cur.text)
+	}
+	if err = p.advance(); err != nil {
+		return "", 0, err
+	}
+
+	if p.cur.kind != tokenRBracket {
+		return "", 0, fmt.Errorf("script: expected ']', got %q", p.cur.text)
+	}
+	if err = p.advance(); err != nil {
+		return "", 0, err
+	}
+
+	return asset, amount, nil
+}
+
+func (p *parser) parseAccountRef() (string, error) {
+	if p.cur.kind != tokenAt {
+		return "", fmt.Errorf("script: expected '@', got %q", p.cur.text)
+	}
+	if err := p.advance(); err != nil {
+		return "", err
+	}
+
+	if p.cur.kind != tokenIdent {
+		return "", fmt.Errorf("script: expected account name, got %q", p.cur.text)
+	}
+	name := p.cur.text
+	if err := p.advance(); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+func (p *parser) parseSource() (SourceExpr, error) {
+	account, err := p.parseAccountRef()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.cur.kind == tokenIdent && p.cur.text == "max" {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		_, maxAmount, err := p.parseAmount()
+		if err != nil {
+			return nil, err
+		}
+		return SourceMax{Account: account, Cap: maxAmount}, nil
+	}
+
+	return SourceAccount{Account: account}, nil
+}
+
+func (p *parser) parseDest() (DestExpr, error) {
+	if p.cur.kind == tokenAt {
+		account, err := p.parseAccountRef()
+		if err != nil {
+			return nil, err
+		}
+		return DestAccount{Account: account}, nil
+	}
+
+	if p.cur.kind != tokenLBrace {
+		return nil, fmt.Errorf("script: expected '@' or '{', got %q", p.cur.text)
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	var portions []Portion
+	for {
+		portion, err := p.parsePortion()
+		if err != nil {
+			return nil, err
+		}
+		portions = append(portions, portion)
+
+		if p.cur.kind == tokenComma {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		break
+	}
+
+	if p.cur.kind != tokenRBrace {
+		return nil, fmt.Errorf("script: expected '}', got %q", p.cur.text)
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	return DestSplit{Portions: portions}, nil
+}
+
+func (p *parser) parsePortion() (Portion, error) {
+	if p.cur.kind != tokenNumber {
+		return Portion{}, fmt.Errorf("script: expected percentage, got %q", p.cur.text)
+	}
+	pct, convErr := strconv.ParseFloat(p.cur.text, 64)
+	if convErr != nil {
+		return Portion{}, fmt.Errorf("script: invalid percentage %q", p.cur.text)
+	}
+	if err := p.advance(); err != nil {
+		return Portion{}, err
+	}
+
+	if p.cur.kind != tokenPercent {
+		return Portion{}, fmt.Errorf("script: expected '%%', got %q", p.cur.text)
+	}
+	if err := p.advance(); err != nil {
+		return Portion{}, err
+	}
+
+	if err := p.expectIdent("to"); err != nil {
+		return Portion{}, err
+	}
+
+	account, err := p.parseAccountRef()
+	if err != nil {
+		return Portion{}, err
+	}
+
+	return Portion{Account: account, Percent: pct}, nil
+}
@@ -0,0 +1,51 @@
+package script
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse_FeeSplit(t *testing.T) {
+	stmt, err := Parse("send [USD 500] from @user1 to { 80% to @user2, 20% to @fees }")
+	assert.NoError(t, err)
+	assert.Equal(t, "USD", stmt.Asset)
+	assert.Equal(t, 500, stmt.Amount)
+	assert.Equal(t, SourceAccount{Account: "user1"}, stmt.Source)
+
+	split, ok := stmt.Dest.(DestSplit)
+	assert.True(t, ok)
+	assert.Equal(t, []Portion{
+		{Account: "user2", Percent: 80},
+		{Account: "fees", Percent: 20},
+	}, split.Portions)
+}
+
+func TestParse_SingleDestination(t *testing.T) {
+	stmt, err := Parse("send [USD 100] from @user1 to @user2")
+	assert.NoError(t, err)
+
+	dest, ok := stmt.Dest.(DestAccount)
+	assert.True(t, ok)
+	assert.Equal(t, "user2", dest.Account)
+}
+
+func TestParse_SourceMax(t *testing.T) {
+	stmt, err := Parse("send [USD 100] from @user1 max [USD 200] to @user2")
+	assert.NoError(t, err)
+
+	source, ok := stmt.Source.(SourceMax)
+	assert.True(t, ok)
+	assert.Equal(t, "user1", source.Account)
+	assert.Equal(t, 200, source.Cap)
+}
+
+func TestParse_MissingKeyword(t *testing.T) {
+	_, err := Parse("send [USD 100] @user1 to @user2")
+	assert.Error(t, err)
+}
+
+func TestParse_UnexpectedTrailingToken(t *testing.T) {
+	_, err := Parse("send [USD 100] from @user1 to @user2 extra")
+	assert.Error(t, err)
+}